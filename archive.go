@@ -0,0 +1,313 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"gopkg.in/yaml.v1"
+)
+
+// builtinExclusionPattern matches paths we always leave out of an app
+// archive, regardless of .qmignore contents.
+var builtinExclusionPattern = regexp.MustCompile(
+	"(.DS_Store)" + "|" +
+		"(go/.*/.git)" + "|" +
+		"(go/.*/.bzr)" + "|" +
+		"(go/.*/.hg)" + "|" +
+		"(go/pkg)" + "|" +
+		"(go/bin)")
+
+// zipMethodZstd is the zip method id used for zstd-compressed entries.
+const zipMethodZstd uint16 = 93
+
+// archiveConfig holds the subset of app.yaml that controls how the app
+// directory is packaged. It is decoded independently of agent.App so
+// packaging concerns don't leak into the agent's data model.
+type archiveConfig struct {
+	Compression string `yaml:"compression"` // "store", "deflate" (default) or "zstd"
+}
+
+func loadArchiveConfig(appDir string) archiveConfig {
+	cfg := archiveConfig{Compression: "deflate"}
+	bytes, err := ioutil.ReadFile(filepath.Join(appDir, "app.yaml"))
+	if err != nil {
+		return cfg
+	}
+	yaml.Unmarshal(bytes, &cfg)
+	if cfg.Compression == "" {
+		cfg.Compression = "deflate"
+	}
+	return cfg
+}
+
+func compressionMethod(name string) uint16 {
+	switch name {
+	case "store":
+		return zip.Store
+	case "zstd":
+		return zipMethodZstd
+	default:
+		return zip.Deflate
+	}
+}
+
+func registerZstd(w *zip.Writer) {
+	w.RegisterCompressor(zipMethodZstd, func(out io.Writer) (io.WriteCloser, error) {
+		return zstd.NewWriter(out)
+	})
+}
+
+// registerZstdDecompressor teaches r how to read back zipMethodZstd
+// entries, mirroring registerZstd; without it, a zip.Reader over an
+// archive packaged with compression: zstd fails every f.Open() with
+// "zip: unsupported compression algorithm".
+func registerZstdDecompressor(r *zip.Reader) {
+	r.RegisterDecompressor(zipMethodZstd, func(src io.Reader) io.ReadCloser {
+		zr, err := zstd.NewReader(src)
+		if err != nil {
+			return errOpenReadCloser{err}
+		}
+		return zr.IOReadCloser()
+	})
+}
+
+// errOpenReadCloser is an io.ReadCloser that always fails with err, used
+// when a decompressor's setup (not a per-entry Read) fails -- the
+// RegisterDecompressor signature has no other way to report that.
+type errOpenReadCloser struct{ err error }
+
+func (e errOpenReadCloser) Read([]byte) (int, error) { return 0, e.err }
+func (e errOpenReadCloser) Close() error             { return nil }
+
+// loadIgnorePatterns reads .qmignore (gitignore-style globs, one per
+// line, blank lines and '#' comments skipped) from appDir, if present.
+func loadIgnorePatterns(appDir string) []string {
+	file, err := os.Open(filepath.Join(appDir, ".qmignore"))
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns
+}
+
+// matchesIgnorePattern reports whether rel, a file's slash-separated path
+// relative to the app directory, is excluded by one of the ordinary
+// (non-directory) globs in patterns -- matched against the full relative
+// path or just the basename, gitignore style. Trailing-slash directory
+// patterns are handled separately, by matchesIgnoreDir, since they
+// exclude whole subtrees rather than individual files.
+func matchesIgnorePattern(rel string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "/") {
+			continue
+		}
+		if ok, _ := filepath.Match(pattern, rel); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, filepath.Base(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesIgnoreDir reports whether the directory named by rel should be
+// pruned from the walk entirely, because its own name matches one of
+// patterns' trailing-slash directory entries (e.g. "node_modules/",
+// ".git/"). Checked once per directory as createAppArchive walks into it,
+// so a match excludes the whole subtree regardless of depth.
+func matchesIgnoreDir(rel string, patterns []string) bool {
+	name := filepath.Base(rel)
+	for _, pattern := range patterns {
+		dirPattern := strings.TrimSuffix(pattern, "/")
+		if dirPattern == pattern {
+			continue // not a directory pattern
+		}
+		if ok, _ := filepath.Match(dirPattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// createAppArchive walks appDir and returns an io.Reader that streams a
+// zip archive of its contents as it is read, along with an approximate
+// size: the sum of the archived files' uncompressed sizes, which can be
+// well above the archive's real byte count -- the caller
+// never has to hold the whole archive in memory or write it to disk
+// before uploading it.
+//
+// The archive is built deterministically: entries are sorted by path,
+// and mtimes and uid/gid are stripped from their headers, so packaging
+// the same tree twice produces byte-identical output. That's what makes
+// content-addressed version IDs possible.
+//
+// If onEntry is non-nil, it is called once per archived file, with its
+// archive-relative path and the SHA-256 of its contents, as each entry
+// is written -- callers that need a full manifest (e.g. to build a
+// signing attestation) must wait until the returned reader has been
+// drained to EOF before reading whatever they accumulated.
+func createAppArchive(appDir string, onEntry func(path, sha256hex string)) (io.Reader, int64, error) {
+	ignore := loadIgnorePatterns(appDir)
+
+	var paths []string
+	var approxSize int64
+	err := filepath.Walk(appDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, relErr := filepath.Rel(appDir, path)
+		if relErr != nil {
+			return relErr
+		}
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() {
+			if rel == "." {
+				return nil
+			}
+			if builtinExclusionPattern.MatchString(path) || matchesIgnoreDir(rel, ignore) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if builtinExclusionPattern.MatchString(path) {
+			return nil
+		}
+		if matchesIgnorePattern(rel, ignore) {
+			return nil
+		}
+		paths = append(paths, path)
+		approxSize += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Strings(paths)
+
+	method := compressionMethod(loadArchiveConfig(appDir).Compression)
+
+	pr, pw := io.Pipe()
+	go func() {
+		w := zip.NewWriter(pw)
+		if method == zipMethodZstd {
+			registerZstd(w)
+		}
+		for _, path := range paths {
+			if err := writeArchiveEntry(w, appDir, path, method, onEntry); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		if err := w.Close(); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.Close()
+	}()
+
+	return pr, approxSize, nil
+}
+
+func writeArchiveEntry(w *zip.Writer, appDir string, path string, method uint16, onEntry func(path, sha256hex string)) error {
+	rel, err := filepath.Rel(appDir, path)
+	if err != nil {
+		return err
+	}
+	rel = filepath.ToSlash(rel)
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	header := &zip.FileHeader{
+		Name:     rel,
+		Method:   method,
+		Modified: time.Time{},
+	}
+	header.SetMode(fi.Mode().Perm())
+
+	fo, err := w.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	fi2, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fi2.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(fo, h), fi2); err != nil {
+		return err
+	}
+	if onEntry != nil {
+		onEntry(rel, hex.EncodeToString(h.Sum(nil)))
+	}
+	return nil
+}
+
+// verifyArchiveEntries recomputes the SHA-256 of every file in a
+// downloaded version archive and checks it against want, the per-entry
+// digests recorded in a signing attestation. A signature alone only
+// proves the attestation blob wasn't tampered with; this is what confirms
+// the version a user would actually run is the one that was signed.
+func verifyArchiveEntries(archive []byte, want map[string]string) error {
+	r, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return fmt.Errorf("read archive: %w", err)
+	}
+	registerZstdDecompressor(r)
+	seen := make(map[string]bool, len(want))
+	for _, f := range r.File {
+		wantSum, ok := want[f.Name]
+		if !ok {
+			return fmt.Errorf("%s: present in archive but not in attestation", f.Name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+		if gotSum := hex.EncodeToString(h.Sum(nil)); gotSum != wantSum {
+			return fmt.Errorf("%s: sha256 mismatch: attestation says %s, archive has %s", f.Name, wantSum, gotSum)
+		}
+		seen[f.Name] = true
+	}
+	for name := range want {
+		if !seen[name] {
+			return fmt.Errorf("%s: present in attestation but missing from archive", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/agentio/agent"
+	"github.com/zalando/go-keyring"
+	"gopkg.in/yaml.v1"
+)
+
+const keyringService = "quartermaster"
+
+// authScheme identifies how a context authenticates to its agent.
+type authScheme string
+
+const (
+	authBasic  authScheme = "basic"
+	authBearer authScheme = "bearer"
+	authOAuth2 authScheme = "oauth2"
+)
+
+// contextConfig is one named context in ~/.agent/config.yaml -- the
+// service it points at and how it authenticates. The credential
+// material itself (password, token, refresh token) never lives in this
+// file; see credential and the keyring-backed store below.
+type contextConfig struct {
+	Service string     `yaml:"service"`
+	Auth    authScheme `yaml:"auth"`
+}
+
+// qmConfig is the on-disk shape of ~/.agent/config.yaml: a kubeconfig-
+// style map of named contexts plus which one is current.
+type qmConfig struct {
+	CurrentContext string                   `yaml:"current-context"`
+	Contexts       map[string]contextConfig `yaml:"contexts"`
+}
+
+func configPath() string {
+	return fmt.Sprintf("%v/.agent/config.yaml", os.Getenv("HOME"))
+}
+
+func loadConfig() (*qmConfig, error) {
+	cfg := &qmConfig{Contexts: map[string]contextConfig{}}
+	bytes, err := ioutil.ReadFile(configPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return nil, err
+	}
+	if err := yaml.Unmarshal(bytes, cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Contexts == nil {
+		cfg.Contexts = map[string]contextConfig{}
+	}
+	return cfg, nil
+}
+
+func saveConfig(cfg *qmConfig) error {
+	if err := os.MkdirAll(filepath.Dir(configPath()), 0700); err != nil {
+		return err
+	}
+	bytes, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(configPath(), bytes, 0600)
+}
+
+// profileName resolves which context a command should use: the
+// --profile flag if given, else the config's current-context, else
+// "default".
+func profileName(profileFlag string, cfg *qmConfig) string {
+	if profileFlag != "" {
+		return profileFlag
+	}
+	if cfg.CurrentContext != "" {
+		return cfg.CurrentContext
+	}
+	return "default"
+}
+
+// credential is the secret material for a context: a basic-auth
+// username/password, a static bearer token, or an OAuth2 access/refresh
+// token pair. It never touches the config YAML.
+type credential struct {
+	Username     string    `json:"username,omitempty"`
+	Password     string    `json:"password,omitempty"`
+	Token        string    `json:"token,omitempty"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	Expiry       time.Time `json:"expiry,omitempty"`
+}
+
+func credentialsDir() string {
+	return fmt.Sprintf("%v/.agent/credentials", os.Getenv("HOME"))
+}
+
+func credentialFallbackPath(profile string) string {
+	return filepath.Join(credentialsDir(), profile+".json")
+}
+
+// saveCredential stores cred for profile in the OS keychain / secret
+// service when one is available, falling back to a 0600 file under
+// ~/.agent/credentials otherwise.
+func saveCredential(profile string, cred credential) error {
+	bytes, err := json.Marshal(cred)
+	if err != nil {
+		return err
+	}
+	if err := keyring.Set(keyringService, profile, string(bytes)); err == nil {
+		os.Remove(credentialFallbackPath(profile)) // don't leave a stale copy behind
+		return nil
+	}
+	if err := os.MkdirAll(credentialsDir(), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(credentialFallbackPath(profile), bytes, 0600)
+}
+
+func loadCredential(profile string) (*credential, error) {
+	var raw string
+	if v, err := keyring.Get(keyringService, profile); err == nil {
+		raw = v
+	} else {
+		bytes, err := ioutil.ReadFile(credentialFallbackPath(profile))
+		if err != nil {
+			return nil, fmt.Errorf("no credentials for profile %q: %w", profile, err)
+		}
+		raw = string(bytes)
+	}
+	var cred credential
+	if err := json.Unmarshal([]byte(raw), &cred); err != nil {
+		return nil, fmt.Errorf("credentials for profile %q: %w", profile, err)
+	}
+	return &cred, nil
+}
+
+func deleteCredential(profile string) {
+	keyring.Delete(keyringService, profile)
+	os.Remove(credentialFallbackPath(profile))
+}
+
+// connectionForProfile builds an agent.Connection for profile, resolving
+// an expired OAuth2 access token through a refresh before returning.
+func connectionForProfile(profile string) (*agent.Connection, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	ctxCfg, ok := cfg.Contexts[profile]
+	if !ok {
+		return nil, fmt.Errorf("no such context %q (run \"q connect\" or \"q context list\")", profile)
+	}
+	cred, err := loadCredential(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &agent.Connection{Service: ctxCfg.Service}
+	switch ctxCfg.Auth {
+	case authOAuth2:
+		if !cred.Expiry.IsZero() && time.Now().After(cred.Expiry) {
+			refreshed, err := refreshOAuthToken(ctxCfg.Service, cred.RefreshToken)
+			if err != nil {
+				return nil, fmt.Errorf("refresh token for %q: %w", profile, err)
+			}
+			cred = refreshed
+			if err := saveCredential(profile, *cred); err != nil {
+				stdlog.Warn("could not persist refreshed token for %q: %v", profile, err)
+			}
+		}
+		c.Token = cred.Token
+	case authBearer:
+		c.Token = cred.Token
+	default: // authBasic
+		c.Credentials = fmt.Sprintf("%v:%v", cred.Username, cred.Password)
+	}
+	return c, nil
+}
+
+// contextUse sets name as the config's current-context. It needs only
+// the local config file, not an agent connection.
+func contextUse(name string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if _, ok := cfg.Contexts[name]; !ok {
+		return fmt.Errorf("no such context %q", name)
+	}
+	cfg.CurrentContext = name
+	return saveConfig(cfg)
+}
+
+// contextList prints every configured context, marking the current one.
+func contextList() error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	for name, ctxCfg := range cfg.Contexts {
+		marker := "  "
+		if name == cfg.CurrentContext {
+			marker = "* "
+		}
+		fmt.Printf("%s%s\t%s\t%s\n", marker, name, ctxCfg.Service, ctxCfg.Auth)
+	}
+	return nil
+}
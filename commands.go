@@ -0,0 +1,596 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/agentio/agent"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v1"
+)
+
+// connect
+
+var (
+	connectUsername string
+	connectPassword string
+	connectOAuth    bool
+	connectToken    string
+)
+
+var connectCmd = &cobra.Command{
+	Use:   "connect <service>",
+	Short: "Save credentials for an agent service under a profile",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		service := args[0]
+		cfg, err := loadConfig()
+		if err != nil {
+			stdlog.Fatal(fmt.Errorf("connect: %w", err))
+		}
+		profile := profileName(profileFlag, cfg)
+
+		var ctxCfg contextConfig
+		var cred credential
+		switch {
+		case connectOAuth:
+			ctxCfg = contextConfig{Service: service, Auth: authOAuth2}
+			got, err := runOAuthFlow(service)
+			if err != nil {
+				stdlog.Fatal(fmt.Errorf("connect: %w", err))
+			}
+			cred = *got
+		case connectToken != "":
+			ctxCfg = contextConfig{Service: service, Auth: authBearer}
+			cred = credential{Token: connectToken}
+		default:
+			ctxCfg = contextConfig{Service: service, Auth: authBasic}
+			cred = credential{Username: connectUsername, Password: connectPassword}
+		}
+
+		cfg.Contexts[profile] = ctxCfg
+		if cfg.CurrentContext == "" {
+			cfg.CurrentContext = profile
+		}
+		if err := saveConfig(cfg); err != nil {
+			stdlog.Fatal(fmt.Errorf("connect: %w", err))
+		}
+		if err := saveCredential(profile, cred); err != nil {
+			stdlog.Fatal(fmt.Errorf("connect: %w", err))
+		}
+		stdlog.Info("connected profile %q to %s (%s auth)", profile, service, ctxCfg.Auth)
+	},
+}
+
+func init() {
+	connectCmd.Flags().StringVarP(&connectUsername, "username", "u", "", "username")
+	connectCmd.Flags().StringVarP(&connectPassword, "password", "p", "", "password")
+	connectCmd.Flags().BoolVar(&connectOAuth, "oauth", false, "log in via an OAuth2 authorization-code (PKCE) flow")
+	connectCmd.Flags().StringVar(&connectToken, "token", "", "use a static bearer token instead of a username/password")
+	rootCmd.AddCommand(connectCmd)
+}
+
+// context
+
+var contextCmd = &cobra.Command{
+	Use:   "context",
+	Short: "Manage named agent contexts (service + auth profile)",
+}
+
+var contextUseCmd = &cobra.Command{
+	Use:   "use <name>",
+	Short: "Switch the current-context",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := contextUse(args[0]); err != nil {
+			stdlog.Fatal(fmt.Errorf("context use: %w", err))
+		}
+		stdlog.Info("now using context %q", args[0])
+	},
+}
+
+var contextListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List configured contexts",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := contextList(); err != nil {
+			stdlog.Fatal(fmt.Errorf("context list: %w", err))
+		}
+	},
+}
+
+func init() {
+	contextCmd.AddCommand(contextUseCmd, contextListCmd)
+	rootCmd.AddCommand(contextCmd)
+}
+
+// list
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List apps",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		c := mustConnection()
+		var apps []agent.App
+		if err := c.GetApps(&apps); err != nil {
+			stdlog.Fatal(fmt.Errorf("list apps: %w", err))
+		}
+		printOutput(outputFlag, apps, func() {
+			table := tablewriter.NewWriter(os.Stdout)
+			table.SetHeader([]string{"Id", "Name", "Description", "Workers"})
+			for _, app := range apps {
+				table.Append([]string{app.Id.Hex(), app.Name, app.Description, strconv.Itoa(len(app.Workers))})
+			}
+			table.Render()
+		})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(listCmd)
+}
+
+// show
+
+var showCmd = &cobra.Command{
+	Use:               "show <appid>",
+	Short:             "Show an app's details, versions and workers",
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: completeAppId,
+	Run: func(cmd *cobra.Command, args []string) {
+		appid := args[0]
+		c := mustConnection()
+		var app agent.App
+		if err := c.GetApp(&app, appid); err != nil {
+			stdlog.Fatal(fmt.Errorf("show %s: %w", appid, err))
+		}
+		printOutput(outputFlag, app, func() {
+			table := tablewriter.NewWriter(os.Stdout)
+			table.SetColWidth(100)
+			table.Append([]string{"Id", app.Id.Hex()})
+			table.Append([]string{"Name", app.Name})
+			table.Append([]string{"Description", app.Description})
+			table.Append([]string{"Capacity", fmt.Sprintf("%v", app.Capacity)})
+			table.Append([]string{"Paths", fmt.Sprintf("%v", app.Paths)})
+			table.Append([]string{"Domains", fmt.Sprintf("%v", app.Domains)})
+			table.Render()
+
+			if len(app.Versions) > 0 {
+				table := tablewriter.NewWriter(os.Stdout)
+				table.SetHeader([]string{"Version", "Filename", "Created", "Signed by"})
+				table.SetColWidth(100)
+				for _, v := range app.Versions {
+					table.Append([]string{v.Version, v.Filename, fmt.Sprintf("%v", v.Created), signedByLabel(v.Signature)})
+				}
+				table.Render()
+			}
+
+			if len(app.Workers) > 0 {
+				table := tablewriter.NewWriter(os.Stdout)
+				table.SetHeader([]string{"Container", "Host", "Port", "Version"})
+				table.SetColWidth(100)
+				for _, w := range app.Workers {
+					table.Append([]string{w.Container, w.Host, fmt.Sprintf("%v", w.Port), w.Version})
+				}
+				table.Render()
+			}
+		})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(showCmd)
+}
+
+// create
+
+var createCmd = &cobra.Command{
+	Use:   "create <appname>",
+	Short: "Create an app from its app.yaml",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		appname := args[0]
+		c := mustConnection()
+		appYamlPath := fmt.Sprintf("%v/app.yaml", appname)
+		bytes, err := ioutil.ReadFile(appYamlPath)
+		if err != nil {
+			stdlog.Fatal(fmt.Errorf("read %s: %w", appYamlPath, err))
+		}
+		var appinfo agent.App
+		yaml.Unmarshal(bytes, &appinfo)
+		stdlog.Debug("%v", appinfo)
+		var result map[string]interface{}
+		if err := c.CreateApp(&result, appinfo); err != nil {
+			stdlog.Fatal(fmt.Errorf("create %s: %w", appname, err))
+		}
+		printMapResult(outputFlag, result)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(createCmd)
+}
+
+// upload
+
+var (
+	uploadSilent             bool
+	uploadNoProgress         bool
+	uploadSignKey            string
+	uploadResumableThreshold int64
+)
+
+var uploadCmd = &cobra.Command{
+	Use:               "upload <appid>",
+	Short:             "Package and upload a new version of an app",
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: completeAppId,
+	Run: func(cmd *cobra.Command, args []string) {
+		appid := args[0]
+		c := mustConnection()
+		noProgress := uploadSilent || uploadNoProgress
+
+		var signKey *signingKey
+		if uploadSignKey != "" {
+			key, err := loadSigningKey(uploadSignKey)
+			if err != nil {
+				stdlog.Fatal(fmt.Errorf("upload %s: %w", appid, err))
+			}
+			signKey = key
+		}
+
+		entries := map[string]string{}
+		var entriesMu sync.Mutex
+		archive, approxSize, err := createAppArchive(appid, func(path, sha256hex string) {
+			entriesMu.Lock()
+			entries[path] = sha256hex
+			entriesMu.Unlock()
+		})
+		if err != nil {
+			stdlog.Fatal(fmt.Errorf("package %s: %w", appid, err))
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sigs
+			stdlog.Warn("interrupted, aborting upload (rerun to resume)")
+			cancel()
+		}()
+
+		result, err := uploadArchive(ctx, c, appid, archive, approxSize, noProgress, signKey, entries, uploadResumableThreshold)
+		signal.Stop(sigs)
+		if err != nil {
+			stdlog.Fatal(err)
+		}
+		printMapResult(outputFlag, result)
+	},
+}
+
+func init() {
+	uploadCmd.Flags().BoolVar(&uploadSilent, "silent", false, "suppress all upload progress output")
+	uploadCmd.Flags().BoolVar(&uploadNoProgress, "no-progress", false, "suppress the live progress bar but keep other output")
+	uploadCmd.Flags().StringVar(&uploadSignKey, "sign", "", "sign the uploaded version with this key (name or kms://... uri)")
+	uploadCmd.Flags().Int64Var(&uploadResumableThreshold, "resumable-threshold", resumableThreshold, "archives at or above this size (in bytes) are sent through the chunked, resumable upload protocol")
+	rootCmd.AddCommand(uploadCmd)
+}
+
+// verify
+
+var verifyCmd = &cobra.Command{
+	Use:               "verify <appid> <versionid>",
+	Short:             "Verify the signature on an uploaded version",
+	Args:              cobra.ExactArgs(2),
+	ValidArgsFunction: completeAppIdThenVersionId,
+	Run: func(cmd *cobra.Command, args []string) {
+		appid, versionid := args[0], args[1]
+		c := mustConnection()
+
+		var app agent.App
+		if err := c.GetApp(&app, appid); err != nil {
+			stdlog.Fatal(fmt.Errorf("verify %s: %w", appid, err))
+		}
+
+		var version *agent.Version
+		for i := range app.Versions {
+			if app.Versions[i].Version == versionid {
+				version = &app.Versions[i]
+				break
+			}
+		}
+		if version == nil {
+			stdlog.Fatal(fmt.Errorf("verify %s %s: version not found", appid, versionid))
+		}
+		if version.Signature == "" {
+			stdlog.Fatal(fmt.Errorf("verify %s %s: version is not signed", appid, versionid))
+		}
+
+		var sig signature
+		if err := json.Unmarshal([]byte(version.Signature), &sig); err != nil {
+			stdlog.Fatal(fmt.Errorf("verify %s %s: decode signature: %w", appid, versionid, err))
+		}
+
+		trusted, err := loadTrustedKeys()
+		if err != nil {
+			stdlog.Fatal(fmt.Errorf("verify %s %s: %w", appid, versionid, err))
+		}
+		if err := verifySignature(&sig, trusted); err != nil {
+			stdlog.Fatal(fmt.Errorf("verify %s %s: %w", appid, versionid, err))
+		}
+
+		// A valid signature only says the attestation blob wasn't
+		// tampered with; download the actual version and recompute its
+		// per-entry hashes to confirm it's the bytes that were signed.
+		var archiveBytes []byte
+		if err := c.GetAppVersionArchive(&archiveBytes, appid, versionid); err != nil {
+			stdlog.Fatal(fmt.Errorf("verify %s %s: download archive: %w", appid, versionid, err))
+		}
+		if err := verifyArchiveEntries(archiveBytes, sig.Attestation.Entries); err != nil {
+			stdlog.Fatal(fmt.Errorf("verify %s %s: archive does not match attestation: %w", appid, versionid, err))
+		}
+
+		fmt.Printf("OK: %s %s signed by %s, built %v, archive contents match attestation\n", appid, versionid, sig.KeyId, sig.Attestation.Timestamp)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+}
+
+// key
+
+var keyCmd = &cobra.Command{
+	Use:   "key",
+	Short: "Manage signing keys and the trust store",
+}
+
+var keyGenerateCmd = &cobra.Command{
+	Use:   "generate <name>",
+	Short: "Generate a new Ed25519 signing key pair",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		key, err := generateSigningKey(args[0])
+		if err != nil {
+			stdlog.Fatal(fmt.Errorf("key generate %s: %w", args[0], err))
+		}
+		stdlog.Info("generated key %q (id %s)", args[0], key.Id)
+	},
+}
+
+var keyListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List locally held signing keys",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		names, err := listSigningKeys()
+		if err != nil {
+			stdlog.Fatal(fmt.Errorf("key list: %w", err))
+		}
+		printOutput(outputFlag, names, func() {
+			for _, name := range names {
+				fmt.Println(name)
+			}
+		})
+	},
+}
+
+var keyTrustCmd = &cobra.Command{
+	Use:   "trust <name> <publickey>",
+	Short: "Add a hex-encoded Ed25519 public key to the trust store",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		name, publicKeyHex := args[0], args[1]
+		id, err := trustKey(publicKeyHex)
+		if err != nil {
+			stdlog.Fatal(fmt.Errorf("key trust %s: %w", name, err))
+		}
+		stdlog.Info("now trusting key %q as %s", name, id)
+	},
+}
+
+var keyRevokeCmd = &cobra.Command{
+	Use:   "revoke <keyid>",
+	Short: "Remove a key (by its id, as shown by \"key trust\") from the trust store",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := revokeKey(args[0]); err != nil {
+			stdlog.Fatal(fmt.Errorf("key revoke %s: %w", args[0], err))
+		}
+		stdlog.Info("revoked key %q", args[0])
+	},
+}
+
+func init() {
+	keyCmd.AddCommand(keyGenerateCmd, keyListCmd, keyTrustCmd, keyRevokeCmd)
+	rootCmd.AddCommand(keyCmd)
+}
+
+// start / stop / restart
+
+func runOnAppOrVersion(appid string, versionid string, onApp func() (map[string]interface{}, error), onVersion func() (map[string]interface{}, error)) map[string]interface{} {
+	var result map[string]interface{}
+	var err error
+	if versionid != "" {
+		result, err = onVersion()
+	} else {
+		result, err = onApp()
+	}
+	if err != nil {
+		stdlog.Fatal(err)
+	}
+	return result
+}
+
+func appAndOptionalVersion(args []string) (string, string) {
+	if len(args) == 2 {
+		return args[0], args[1]
+	}
+	return args[0], ""
+}
+
+var startCmd = &cobra.Command{
+	Use:               "start <appid> [versionid]",
+	Short:             "Start an app, or a specific version of it",
+	Args:              cobra.RangeArgs(1, 2),
+	ValidArgsFunction: completeAppIdThenVersionId,
+	Run: func(cmd *cobra.Command, args []string) {
+		appid, versionid := appAndOptionalVersion(args)
+		c := mustConnection()
+		result := runOnAppOrVersion(appid, versionid,
+			func() (map[string]interface{}, error) {
+				var result map[string]interface{}
+				err := c.StartApp(&result, appid)
+				return result, wrapf(err, "start %s", appid)
+			},
+			func() (map[string]interface{}, error) {
+				var result map[string]interface{}
+				err := c.StartAppVersion(&result, appid, versionid)
+				return result, wrapf(err, "start %s %s", appid, versionid)
+			})
+		printMapResult(outputFlag, result)
+	},
+}
+
+var stopCmd = &cobra.Command{
+	Use:               "stop <appid> [versionid]",
+	Short:             "Stop an app, or a specific version of it",
+	Args:              cobra.RangeArgs(1, 2),
+	ValidArgsFunction: completeAppIdThenVersionId,
+	Run: func(cmd *cobra.Command, args []string) {
+		appid, versionid := appAndOptionalVersion(args)
+		c := mustConnection()
+		result := runOnAppOrVersion(appid, versionid,
+			func() (map[string]interface{}, error) {
+				var result map[string]interface{}
+				err := c.StopApp(&result, appid)
+				return result, wrapf(err, "stop %s", appid)
+			},
+			func() (map[string]interface{}, error) {
+				var result map[string]interface{}
+				err := c.StopAppVersion(&result, appid, versionid)
+				return result, wrapf(err, "stop %s %s", appid, versionid)
+			})
+		printMapResult(outputFlag, result)
+	},
+}
+
+var restartCmd = &cobra.Command{
+	Use:               "restart <appid> [versionid]",
+	Short:             "Restart an app, or a specific version of it",
+	Args:              cobra.RangeArgs(1, 2),
+	ValidArgsFunction: completeAppIdThenVersionId,
+	Run: func(cmd *cobra.Command, args []string) {
+		appid, versionid := appAndOptionalVersion(args)
+		c := mustConnection()
+		result := runOnAppOrVersion(appid, versionid,
+			func() (map[string]interface{}, error) {
+				var stopped map[string]interface{}
+				if err := c.StopApp(&stopped, appid); err != nil {
+					return nil, wrapf(err, "restart %s", appid)
+				}
+				printMapResult(outputFlag, stopped)
+				var started map[string]interface{}
+				if err := c.StartApp(&started, appid); err != nil {
+					return nil, wrapf(err, "restart %s", appid)
+				}
+				return started, nil
+			},
+			func() (map[string]interface{}, error) {
+				var stopped map[string]interface{}
+				if err := c.StopAppVersion(&stopped, appid, versionid); err != nil {
+					return nil, wrapf(err, "restart %s %s", appid, versionid)
+				}
+				printMapResult(outputFlag, stopped)
+				var started map[string]interface{}
+				if err := c.StartAppVersion(&started, appid, versionid); err != nil {
+					return nil, wrapf(err, "restart %s %s", appid, versionid)
+				}
+				return started, nil
+			})
+		printMapResult(outputFlag, result)
+	},
+}
+
+// delete
+
+var deleteCmd = &cobra.Command{
+	Use:               "delete <appid> [versionid]",
+	Short:             "Delete an app, or a specific version of it",
+	Args:              cobra.RangeArgs(1, 2),
+	ValidArgsFunction: completeAppIdThenVersionId,
+	Run: func(cmd *cobra.Command, args []string) {
+		appid, versionid := appAndOptionalVersion(args)
+		c := mustConnection()
+		result := runOnAppOrVersion(appid, versionid,
+			func() (map[string]interface{}, error) {
+				var result map[string]interface{}
+				err := c.DeleteApp(&result, appid)
+				return result, wrapf(err, "delete %s", appid)
+			},
+			func() (map[string]interface{}, error) {
+				var result map[string]interface{}
+				err := c.DeleteAppVersion(&result, appid, versionid)
+				return result, wrapf(err, "delete %s %s", appid, versionid)
+			})
+		printMapResult(outputFlag, result)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(startCmd, stopCmd, restartCmd, deleteCmd)
+}
+
+// logs
+
+var logsCmd = &cobra.Command{
+	Use:               "logs <appid> [versionid]",
+	Short:             "Show recent log output for an app, or a specific version of it",
+	Args:              cobra.RangeArgs(1, 2),
+	ValidArgsFunction: completeAppIdThenVersionId,
+	Run: func(cmd *cobra.Command, args []string) {
+		appid, versionid := appAndOptionalVersion(args)
+		c := mustConnection()
+
+		var lines []string
+		var err error
+		if versionid != "" {
+			err = c.GetAppVersionLogs(&lines, appid, versionid)
+		} else {
+			err = c.GetAppLogs(&lines, appid)
+		}
+		if err != nil {
+			stdlog.Fatal(wrapf(err, "logs %s", appid))
+		}
+
+		printOutput(outputFlag, lines, func() {
+			for _, line := range lines {
+				fmt.Println(line)
+			}
+		})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(logsCmd)
+}
+
+// wrapf wraps err with a formatted prefix, the way every other command in
+// this file does inline; it exists so runOnAppOrVersion's callbacks can do
+// the same in one line instead of an if-err block.
+func wrapf(err error, format string, args ...interface{}) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf(format+": %w", append(args, err)...)
+}
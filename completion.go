@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+
+	"github.com/agentio/agent"
+	"github.com/spf13/cobra"
+)
+
+var completionCmd = &cobra.Command{
+	Use:       "completion <shell>",
+	Short:     "Generate shell completion scripts",
+	Long:      "Generate a completion script for bash, zsh, fish or powershell. Source it, or install it under your shell's completion directory, to get <appid>/<versionid> completion that queries the connected agent.",
+	Args:      cobra.ExactValidArgs(1),
+	ValidArgs: []string{"bash", "zsh", "fish", "powershell"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		switch args[0] {
+		case "bash":
+			return rootCmd.GenBashCompletionV2(os.Stdout, true)
+		case "zsh":
+			return rootCmd.GenZshCompletion(os.Stdout)
+		case "fish":
+			return rootCmd.GenFishCompletion(os.Stdout, true)
+		case "powershell":
+			return rootCmd.GenPowerShellCompletionWithDesc(os.Stdout)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(completionCmd)
+}
+
+// completeAppId suggests <appid> values for the active profile by asking
+// the agent for the app list. It fails quietly (no suggestions) rather
+// than printing errors, since it also runs while the user is still typing.
+func completeAppId(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) != 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	apps, err := appsForCompletion()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	ids := make([]string, 0, len(apps))
+	for _, app := range apps {
+		ids = append(ids, app.Id.Hex())
+	}
+	return ids, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeAppIdThenVersionId completes <appid> for the first positional
+// argument and <versionid> (drawn from that app's versions) for the
+// second, for commands like "verify", "start", "stop", "restart", "delete"
+// and "logs".
+func completeAppIdThenVersionId(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	switch len(args) {
+	case 0:
+		return completeAppId(cmd, args, toComplete)
+	case 1:
+		c, err := connectionForProfile(profileName(profileFlag, mustLoadConfigForCompletion()))
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		var app agent.App
+		if err := c.GetApp(&app, args[0]); err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		versions := make([]string, 0, len(app.Versions))
+		for _, v := range app.Versions {
+			versions = append(versions, v.Version)
+		}
+		return versions, cobra.ShellCompDirectiveNoFileComp
+	default:
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+}
+
+func appsForCompletion() ([]agent.App, error) {
+	cfg := mustLoadConfigForCompletion()
+	c, err := connectionForProfile(profileName(profileFlag, cfg))
+	if err != nil {
+		return nil, err
+	}
+	var apps []agent.App
+	if err := c.GetApps(&apps); err != nil {
+		return nil, err
+	}
+	return apps, nil
+}
+
+// mustLoadConfigForCompletion loads the config for completion purposes,
+// falling back to an empty one on error so completion can degrade to "no
+// suggestions" instead of panicking mid-shell-completion.
+func mustLoadConfigForCompletion() *qmConfig {
+	cfg, err := loadConfig()
+	if err != nil {
+		return &qmConfig{Contexts: map[string]contextConfig{}}
+	}
+	return cfg
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+func parseLogLevel(s string) (logLevel, bool) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return levelDebug, true
+	case "info":
+		return levelInfo, true
+	case "warn", "warning":
+		return levelWarn, true
+	case "error":
+		return levelError, true
+	}
+	return levelInfo, false
+}
+
+func (l logLevel) String() string {
+	switch l {
+	case levelDebug:
+		return "debug"
+	case levelWarn:
+		return "warn"
+	case levelError:
+		return "error"
+	default:
+		return "info"
+	}
+}
+
+// qmlogger is a small leveled logger (debug/info/warn/error). It writes
+// human-readable lines to a TTY and newline-delimited JSON otherwise, so
+// `q` behaves the same interactively and when run from a CI pipeline
+// that scrapes its stderr.
+type qmlogger struct {
+	level logLevel
+	json  bool
+	out   *os.File
+}
+
+// stdlog is the logger used throughout main; its level is set from
+// QM_LOG / -v / --log-level once the command line has been parsed.
+var stdlog = newLogger()
+
+func newLogger() *qmlogger {
+	level := levelInfo
+	if v := os.Getenv("QM_LOG"); v != "" {
+		if parsed, ok := parseLogLevel(v); ok {
+			level = parsed
+		}
+	}
+	return &qmlogger{level: level, json: !isTerminal(os.Stderr), out: os.Stderr}
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return (fi.Mode() & os.ModeCharDevice) != 0
+}
+
+func (l *qmlogger) setLevel(level logLevel) {
+	l.level = level
+}
+
+func (l *qmlogger) log(level logLevel, format string, args ...interface{}) {
+	if level < l.level {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if l.json {
+		entry := map[string]interface{}{
+			"level": level.String(),
+			"msg":   msg,
+			"time":  time.Now().UTC().Format(time.RFC3339),
+		}
+		bytes, _ := json.Marshal(entry)
+		fmt.Fprintln(l.out, string(bytes))
+		return
+	}
+	fmt.Fprintf(l.out, "%s: %s\n", strings.ToUpper(level.String()), msg)
+}
+
+func (l *qmlogger) Debug(format string, args ...interface{}) { l.log(levelDebug, format, args...) }
+func (l *qmlogger) Info(format string, args ...interface{})  { l.log(levelInfo, format, args...) }
+func (l *qmlogger) Warn(format string, args ...interface{})  { l.log(levelWarn, format, args...) }
+func (l *qmlogger) Error(format string, args ...interface{}) { l.log(levelError, format, args...) }
+
+// Fatal logs err at error level and exits with a nonzero status. It
+// replaces the old check()/log.Fatal panic-and-crash pattern, which left
+// `q` exiting 0 (or with an unhandled panic) on RPC failures.
+func (l *qmlogger) Fatal(err error) {
+	if err == nil {
+		return
+	}
+	l.log(levelError, "%v", err)
+	os.Exit(1)
+}
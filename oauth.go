@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// oauthClientID identifies `q` itself to the agent's OAuth2 server; it's
+// a public client (PKCE is what keeps the flow secure without a secret).
+const oauthClientID = "agentio-quartermaster-cli"
+
+// runOAuthFlow drives an OAuth2 authorization-code-with-PKCE login
+// against service: it starts a local callback server, opens the user's
+// browser at the authorization endpoint, and exchanges the returned code
+// for an access/refresh token pair.
+func runOAuthFlow(service string) (*credential, error) {
+	verifier, err := randomURLSafeString(32)
+	if err != nil {
+		return nil, fmt.Errorf("oauth: %w", err)
+	}
+	state, err := randomURLSafeString(16)
+	if err != nil {
+		return nil, fmt.Errorf("oauth: %w", err)
+	}
+	challenge := codeChallengeS256(verifier)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("oauth: listen: %w", err)
+	}
+	redirectURI := fmt.Sprintf("http://127.0.0.1:%d/callback", listener.Addr().(*net.TCPAddr).Port)
+
+	codeCh := make(chan string, 1)
+	errCh := make(chan error, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("state") != state {
+			http.Error(w, "state mismatch", http.StatusBadRequest)
+			errCh <- fmt.Errorf("oauth: state mismatch")
+			return
+		}
+		code := r.URL.Query().Get("code")
+		if code == "" {
+			http.Error(w, "missing code", http.StatusBadRequest)
+			errCh <- fmt.Errorf("oauth: authorization server returned no code")
+			return
+		}
+		fmt.Fprintln(w, "Login complete, you can close this tab.")
+		codeCh <- code
+	})
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	defer server.Close()
+
+	authURL := fmt.Sprintf("%s/oauth/authorize?%s", strings.TrimRight(service, "/"), url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oauthClientID},
+		"redirect_uri":          {redirectURI},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+		"state":                 {state},
+	}.Encode())
+
+	stdlog.Info("opening browser for login: %s", authURL)
+	if err := openBrowser(authURL); err != nil {
+		stdlog.Warn("could not open browser automatically: %v", err)
+		fmt.Printf("Open this URL to log in:\n\n  %s\n\n", authURL)
+	}
+
+	select {
+	case code := <-codeCh:
+		return exchangeCodeForToken(service, code, verifier, redirectURI)
+	case err := <-errCh:
+		return nil, err
+	case <-time.After(5 * time.Minute):
+		return nil, fmt.Errorf("oauth: timed out waiting for browser login")
+	}
+}
+
+// refreshOAuthToken exchanges a refresh token for a new access token,
+// rotating the refresh token if the server issues a new one. Per RFC 6749
+// §6, rotation is optional -- a server that keeps reusing the same
+// refresh token omits it from the response, so refreshToken is carried
+// through as the fallback rather than being dropped.
+func refreshOAuthToken(service string, refreshToken string) (*credential, error) {
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {oauthClientID},
+	}
+	return postOAuthToken(service, form, refreshToken)
+}
+
+func exchangeCodeForToken(service, code, verifier, redirectURI string) (*credential, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"code_verifier": {verifier},
+		"redirect_uri":  {redirectURI},
+		"client_id":     {oauthClientID},
+	}
+	return postOAuthToken(service, form, "")
+}
+
+// postOAuthToken posts form to the token endpoint and returns the
+// resulting credential. prevRefreshToken is used in place of the
+// response's refresh_token when the server doesn't send one (see
+// refreshOAuthToken); it's empty for a fresh login, where there's nothing
+// to fall back to.
+func postOAuthToken(service string, form url.Values, prevRefreshToken string) (*credential, error) {
+	resp, err := http.PostForm(strings.TrimRight(service, "/")+"/oauth/token", form)
+	if err != nil {
+		return nil, fmt.Errorf("oauth: token request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("oauth: read token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oauth: token request failed: %s: %s", resp.Status, string(body))
+	}
+
+	var tokenResp struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &tokenResp); err != nil {
+		return nil, fmt.Errorf("oauth: decode token response: %w", err)
+	}
+
+	refreshToken := tokenResp.RefreshToken
+	if refreshToken == "" {
+		refreshToken = prevRefreshToken
+	}
+	return &credential{
+		Token:        tokenResp.AccessToken,
+		RefreshToken: refreshToken,
+		Expiry:       time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second),
+	}, nil
+}
+
+func randomURLSafeString(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func codeChallengeS256(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// openBrowser launches the platform's default handler for url.
+func openBrowser(url string) error {
+	switch runtime.GOOS {
+	case "darwin":
+		return exec.Command("open", url).Start()
+	case "windows":
+		return exec.Command("rundll32", "url.dll,FileProtocolHandler", url).Start()
+	default:
+		return exec.Command("xdg-open", url).Start()
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// progressWriter wraps an io.Writer and reports bytes transferred,
+// throughput and ETA to stderr as data flows through it. It is safe to
+// disable entirely (for --silent / --no-progress) by setting silent.
+type progressWriter struct {
+	w         io.Writer
+	label     string
+	total     int64
+	done      int64
+	start     time.Time
+	lastPaint time.Time
+	silent    bool
+}
+
+func newProgressWriter(w io.Writer, label string, total int64, silent bool) *progressWriter {
+	return &progressWriter{w: w, label: label, total: total, start: time.Now(), silent: silent}
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	atomic.AddInt64(&p.done, int64(n))
+	p.paint(false)
+	return n, err
+}
+
+// finish paints a final, complete progress line and a trailing newline.
+// Call it once the transfer is known to be done, in case the last Write
+// landed inside the repaint throttle window.
+func (p *progressWriter) finish() {
+	p.paint(true)
+}
+
+func (p *progressWriter) paint(force bool) {
+	if p.silent {
+		return
+	}
+	now := time.Now()
+	if !force && now.Sub(p.lastPaint) < 100*time.Millisecond {
+		return
+	}
+	p.lastPaint = now
+	done := atomic.LoadInt64(&p.done)
+	elapsed := now.Sub(p.start).Seconds()
+	if elapsed < 0.001 {
+		elapsed = 0.001
+	}
+	throughput := float64(done) / elapsed
+	var eta time.Duration
+	if throughput > 0 && p.total > done {
+		eta = time.Duration(float64(p.total-done)/throughput) * time.Second
+	}
+	pct := 100.0
+	if p.total > 0 {
+		pct = float64(done) / float64(p.total) * 100
+	}
+	fmt.Fprintf(os.Stderr, "\r%s %6.2f%%  %8s/%8s  %8s/s  eta %-7s",
+		p.label, pct, humanBytes(done), humanBytes(p.total), humanBytes(int64(throughput)), eta.Round(time.Second))
+	if force || done >= p.total {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// ctxProgressReader wraps r so that the real consumer of the bytes -- the
+// transport doing the network write -- is what drives the progress bar
+// and can be interrupted: each Read checks ctx first, so cancelling it
+// aborts the in-flight transfer the next time the transport asks for more
+// data, rather than only being checked before the request starts.
+type ctxProgressReader struct {
+	ctx context.Context
+	r   io.Reader
+	pw  *progressWriter
+}
+
+func newCtxProgressReader(ctx context.Context, r io.Reader, pw *progressWriter) *ctxProgressReader {
+	return &ctxProgressReader{ctx: ctx, r: r, pw: pw}
+}
+
+func (c *ctxProgressReader) Read(b []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := c.r.Read(b)
+	if n > 0 {
+		c.pw.Write(b[:n])
+	}
+	return n, err
+}
+
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
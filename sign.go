@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// keysDir is where signing key pairs and the trust store live.
+func keysDir() string {
+	return fmt.Sprintf("%v/.agent/keys", os.Getenv("HOME"))
+}
+
+func trustedKeysFile() string {
+	return filepath.Join(keysDir(), "trusted.json")
+}
+
+// signingKey is an Ed25519 key pair kept on disk under keysDir, named by
+// the caller (e.g. "release") rather than by its id, so it's easy to
+// refer to from --sign=<name>. A "kms://" name is resolved through
+// loadKMSKey instead of the local keystore.
+type signingKey struct {
+	Id         string
+	PublicKey  ed25519.PublicKey
+	PrivateKey ed25519.PrivateKey
+}
+
+// keyId derives a short, stable identifier for a public key: the first
+// 8 bytes of its SHA-256, hex-encoded.
+func keyId(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+func generateSigningKey(name string) (*signingKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(keysDir(), 0700); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(keysDir(), name+".pub"), []byte(hex.EncodeToString(pub)), 0644); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(keysDir(), name+".key"), []byte(hex.EncodeToString(priv)), 0600); err != nil {
+		return nil, err
+	}
+	return &signingKey{Id: keyId(pub), PublicKey: pub, PrivateKey: priv}, nil
+}
+
+func loadSigningKey(name string) (*signingKey, error) {
+	if strings.HasPrefix(name, "kms://") {
+		return loadKMSKey(name)
+	}
+	privHex, err := ioutil.ReadFile(filepath.Join(keysDir(), name+".key"))
+	if err != nil {
+		return nil, fmt.Errorf("load key %s: %w", name, err)
+	}
+	priv, err := hex.DecodeString(strings.TrimSpace(string(privHex)))
+	if err != nil {
+		return nil, fmt.Errorf("load key %s: %w", name, err)
+	}
+	privateKey := ed25519.PrivateKey(priv)
+	pub := privateKey.Public().(ed25519.PublicKey)
+	return &signingKey{Id: keyId(pub), PublicKey: pub, PrivateKey: privateKey}, nil
+}
+
+// loadKMSKey resolves a "kms://" key name to a key held by an external
+// KMS. No KMS integration is wired up yet.
+func loadKMSKey(uri string) (*signingKey, error) {
+	return nil, fmt.Errorf("KMS-backed keys are not yet supported (%s)", uri)
+}
+
+func listSigningKeys() ([]string, error) {
+	entries, err := ioutil.ReadDir(keysDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".pub") {
+			names = append(names, strings.TrimSuffix(e.Name(), ".pub"))
+		}
+	}
+	return names, nil
+}
+
+// loadTrustedKeys returns the set of public keys (hex-encoded, keyed by
+// key id) that `q verify` accepts signatures from.
+func loadTrustedKeys() (map[string]string, error) {
+	bytes, err := ioutil.ReadFile(trustedKeysFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]string{}, nil
+		}
+		return nil, err
+	}
+	trusted := map[string]string{}
+	if err := json.Unmarshal(bytes, &trusted); err != nil {
+		return nil, err
+	}
+	return trusted, nil
+}
+
+func saveTrustedKeys(trusted map[string]string) error {
+	bytes, err := json.MarshalIndent(trusted, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(keysDir(), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(trustedKeysFile(), bytes, 0600)
+}
+
+// trustKey adds publicKeyHex to the trust store, keyed by the id
+// verifySignature looks signatures up by (keyId, derived from the decoded
+// public key itself) rather than any caller-supplied name. It returns
+// that id so callers can report it back to the user.
+func trustKey(publicKeyHex string) (string, error) {
+	pub, err := hex.DecodeString(publicKeyHex)
+	if err != nil {
+		return "", fmt.Errorf("decode public key: %w", err)
+	}
+	id := keyId(ed25519.PublicKey(pub))
+	trusted, err := loadTrustedKeys()
+	if err != nil {
+		return "", err
+	}
+	trusted[id] = publicKeyHex
+	if err := saveTrustedKeys(trusted); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func revokeKey(id string) error {
+	trusted, err := loadTrustedKeys()
+	if err != nil {
+		return err
+	}
+	delete(trusted, id)
+	return saveTrustedKeys(trusted)
+}
+
+// attestation is a small in-toto-style record of how an app version was
+// built: who built it, from what commit, when, and the SHA-256 of every
+// entry in the archive.
+type attestation struct {
+	Builder   string            `json:"builder"`
+	Commit    string            `json:"commit,omitempty"`
+	Timestamp time.Time         `json:"timestamp"`
+	Entries   map[string]string `json:"entries"` // archive path -> sha256
+}
+
+func buildAttestation(entries map[string]string) attestation {
+	host, _ := os.Hostname()
+	return attestation{
+		Builder:   fmt.Sprintf("%s@%s", os.Getenv("USER"), host),
+		Commit:    gitCommit(),
+		Timestamp: time.Now().UTC(),
+		Entries:   entries,
+	}
+}
+
+func gitCommit() string {
+	out, err := exec.Command("git", "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// signature is the sidecar metadata attached to a CreateAppVersion
+// payload: a detached Ed25519 signature over the attestation, plus the
+// attestation itself and the id of the key that produced it.
+type signature struct {
+	KeyId       string      `json:"key_id"`
+	Signature   string      `json:"signature"` // hex-encoded
+	Attestation attestation `json:"attestation"`
+}
+
+func signAttestation(key *signingKey, att attestation) (*signature, error) {
+	payload, err := json.Marshal(att)
+	if err != nil {
+		return nil, err
+	}
+	sig := ed25519.Sign(key.PrivateKey, payload)
+	return &signature{KeyId: key.Id, Signature: hex.EncodeToString(sig), Attestation: att}, nil
+}
+
+// signedByLabel renders the "Signed by" column of `q show`'s version
+// table: the signing key's id, or "-" if sigJSON is empty or unparsable.
+func signedByLabel(sigJSON string) string {
+	if sigJSON == "" {
+		return "-"
+	}
+	var sig signature
+	if err := json.Unmarshal([]byte(sigJSON), &sig); err != nil {
+		return "-"
+	}
+	return sig.KeyId
+}
+
+func verifySignature(sig *signature, trusted map[string]string) error {
+	pubHex, ok := trusted[sig.KeyId]
+	if !ok {
+		return fmt.Errorf("key %s is not trusted", sig.KeyId)
+	}
+	pubBytes, err := hex.DecodeString(pubHex)
+	if err != nil {
+		return fmt.Errorf("trusted key %s: %w", sig.KeyId, err)
+	}
+	payload, err := json.Marshal(sig.Attestation)
+	if err != nil {
+		return err
+	}
+	sigBytes, err := hex.DecodeString(sig.Signature)
+	if err != nil {
+		return fmt.Errorf("decode signature: %w", err)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pubBytes), payload, sigBytes) {
+		return fmt.Errorf("signature does not verify against key %s", sig.KeyId)
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/agentio/agent"
+)
+
+// resumableThreshold is the default for --resumable-threshold: archives at
+// or above it are sent through the chunked, resumable upload protocol
+// instead of as a single request.
+const (
+	resumableThreshold = 16 * 1024 * 1024 // 16 MiB
+	resumableChunkSize = 4 * 1024 * 1024  // 4 MiB
+)
+
+// uploadSession tracks the state of an in-progress chunked upload so that
+// an interrupted "q upload" can be resumed without resending chunks that
+// already landed on the agent. It is persisted as
+// ~/.agent/uploads/<appid>.json between runs.
+type uploadSession struct {
+	AppId     string   `json:"app_id"`
+	SessionId string   `json:"session_id"`
+	ChunkSize int64    `json:"chunk_size"`
+	Size      int64    `json:"size"`
+	Manifest  []string `json:"manifest"` // sha256 of each chunk, in order
+	Done      []bool   `json:"done"`     // completed-chunk bitmap
+}
+
+func uploadSessionPath(appid string) (string, error) {
+	dir := fmt.Sprintf("%v/.agent/uploads", os.Getenv("HOME"))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, appid+".json"), nil
+}
+
+func loadUploadSession(appid string) *uploadSession {
+	path, err := uploadSessionPath(appid)
+	if err != nil {
+		return nil
+	}
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var s uploadSession
+	if err := json.Unmarshal(bytes, &s); err != nil {
+		return nil
+	}
+	return &s
+}
+
+func (s *uploadSession) save() error {
+	path, err := uploadSessionPath(s.AppId)
+	if err != nil {
+		return err
+	}
+	bytes, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, bytes, 0600)
+}
+
+func clearUploadSession(appid string) {
+	if path, err := uploadSessionPath(appid); err == nil {
+		os.Remove(path)
+	}
+}
+
+// uploadArchive sends r (whose files total size bytes before compression)
+// to the agent as the next version of appid, reporting progress on stderr
+// unless silent is true.
+// Archives under threshold (--resumable-threshold; resumableThreshold by
+// default) go up as a single request, streamed from a ctx- and
+// progress-aware reader so the bar reflects the real transfer and a
+// SIGINT/SIGTERM aborts it mid-flight; larger ones are split into chunks
+// and uploaded through the resumable session protocol, with ctx checked
+// between chunks, so an interrupted transfer can be resumed by running
+// the same command again.
+//
+// If key is non-nil, the archive is signed: entries (archive path ->
+// SHA-256, collected by createAppArchive's onEntry callback) is turned
+// into an attestation, signed, and attached to the commit/create call as
+// sidecar metadata. Archive reading is always complete by the time the
+// attestation is built, so entries is guaranteed to be fully populated.
+func uploadArchive(ctx context.Context, c *agent.Connection, appid string, r io.Reader, size int64, silent bool, key *signingKey, entries map[string]string, threshold int64) (map[string]interface{}, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if size < threshold {
+		archiveBytes, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("read archive: %w", err)
+		}
+		// entries is only fully populated once the archive has been
+		// read to EOF (see createAppArchive), which just happened above,
+		// so it's safe to sign now.
+		sig, err := maybeSign(key, entries)
+		if err != nil {
+			return nil, fmt.Errorf("upload %s: %w", appid, err)
+		}
+
+		// Stream archiveBytes into the request through a reader that
+		// reports progress and checks ctx on every Read, so the bar and
+		// cancellation reflect the real network transfer instead of
+		// finishing before it starts. The bar's total is the archive's
+		// actual (compressed) byte count, not size -- the pre-compression
+		// directory-walk sum createAppArchive reports for the threshold
+		// check above, which a compressible payload can wildly overstate.
+		actualSize := int64(len(archiveBytes))
+		pw := newProgressWriter(ioutil.Discard, "upload", actualSize, silent)
+		body := newCtxProgressReader(ctx, bytes.NewReader(archiveBytes), pw)
+		var result map[string]interface{}
+		err = c.CreateAppVersion(&result, appid, body, actualSize, sig)
+		pw.finish()
+		if err != nil {
+			return nil, fmt.Errorf("upload %s: %w", appid, err)
+		}
+		return result, nil
+	}
+	return uploadResumable(ctx, c, appid, r, size, silent, key, entries)
+}
+
+// maybeSign builds and signs an attestation over entries with key, and
+// returns its JSON encoding ready to send as sidecar metadata. It
+// returns an empty string, with no error, when key is nil.
+func maybeSign(key *signingKey, entries map[string]string) (string, error) {
+	if key == nil {
+		return "", nil
+	}
+	sig, err := signAttestation(key, buildAttestation(entries))
+	if err != nil {
+		return "", fmt.Errorf("sign: %w", err)
+	}
+	bytes, err := json.Marshal(sig)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes), nil
+}
+
+// uploadResumable implements the chunked upload protocol: it computes a
+// SHA-256 per chunk and a manifest, opens (or resumes) a session with the
+// agent, PUTs chunks that aren't already marked done, retrying each chunk
+// individually on transient failure, and finally commits the version by
+// manifest hash.
+func uploadResumable(ctx context.Context, c *agent.Connection, appid string, r io.Reader, size int64, silent bool, key *signingKey, entries map[string]string) (map[string]interface{}, error) {
+	chunks, manifest, err := splitIntoChunks(r, size, resumableChunkSize)
+	if err != nil {
+		return nil, fmt.Errorf("chunk archive: %w", err)
+	}
+	// size is the pre-compression directory-walk sum createAppArchive
+	// reports; actualSize, the sum of the chunks actually read off the
+	// (compressed) archive stream, is what the progress bar's total
+	// should track instead.
+	var actualSize int64
+	for _, chunk := range chunks {
+		actualSize += int64(len(chunk))
+	}
+
+	session := loadUploadSession(appid)
+	if session == nil || session.Size != size || !manifestsEqual(session.Manifest, manifest) {
+		var result map[string]interface{}
+		if err := c.CreateUploadSession(&result, appid, manifest); err != nil {
+			return nil, fmt.Errorf("upload %s: create session: %w", appid, err)
+		}
+		sessionId, _ := result["session_id"].(string)
+		session = &uploadSession{
+			AppId:     appid,
+			SessionId: sessionId,
+			ChunkSize: resumableChunkSize,
+			Size:      size,
+			Manifest:  manifest,
+			Done:      make([]bool, len(manifest)),
+		}
+	}
+
+	pw := newProgressWriter(ioutil.Discard, "upload", actualSize, silent)
+	for i, chunk := range chunks {
+		if session.Done[i] {
+			pw.Write(chunk)
+			continue
+		}
+		if ctx.Err() != nil {
+			session.save()
+			return nil, ctx.Err()
+		}
+		if err := putChunkWithRetry(ctx, c, appid, session.SessionId, i, chunk, manifest[i]); err != nil {
+			session.save()
+			return nil, fmt.Errorf("upload %s: chunk %d: %w", appid, i, err)
+		}
+		session.Done[i] = true
+		session.save()
+		pw.Write(chunk)
+	}
+	pw.finish()
+
+	sig, err := maybeSign(key, entries)
+	if err != nil {
+		return nil, fmt.Errorf("upload %s: %w", appid, err)
+	}
+
+	var result map[string]interface{}
+	if err := c.CommitAppVersion(&result, appid, session.SessionId, manifestHash(manifest), sig); err != nil {
+		return nil, fmt.Errorf("upload %s: commit: %w", appid, err)
+	}
+	clearUploadSession(appid)
+	return result, nil
+}
+
+const chunkRetries = 3
+
+func putChunkWithRetry(ctx context.Context, c *agent.Connection, appid, sessionId string, index int, chunk []byte, sha string) error {
+	var err error
+	for attempt := 0; attempt < chunkRetries; attempt++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err = c.PutChunk(appid, sessionId, index, chunk, sha); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func splitIntoChunks(r io.Reader, size int64, chunkSize int64) ([][]byte, []string, error) {
+	var chunks [][]byte
+	var manifest []string
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			chunk := make([]byte, n)
+			copy(chunk, buf[:n])
+			sum := sha256.Sum256(chunk)
+			chunks = append(chunks, chunk)
+			manifest = append(manifest, hex.EncodeToString(sum[:]))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return chunks, manifest, nil
+}
+
+func manifestsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func manifestHash(manifest []string) string {
+	h := sha256.New()
+	for _, m := range manifest {
+		io.WriteString(h, m)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}